@@ -0,0 +1,135 @@
+package compose
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+)
+
+// EventKind identifies a known, actionable compose output pattern.
+type EventKind int
+
+const (
+	// EventPortAllocated is emitted when compose fails to bind a host
+	// port because something else is already using it.
+	EventPortAllocated EventKind = iota
+	// EventPullAccessDenied is emitted when compose can't pull an image,
+	// typically due to missing registry credentials.
+	EventPullAccessDenied
+	// EventNoSpace is emitted when the Docker host is out of disk space.
+	EventNoSpace
+)
+
+// Event describes a known pattern an AnnotatingWriter matched in compose's
+// output.
+type Event struct {
+	Kind EventKind
+	Line string
+	Hint string
+}
+
+// EventHook is called for every Event an AnnotatingWriter detects, so that
+// higher-level commands can react, e.g. prompting the user instead of
+// letting compose fail with an opaque exit status.
+type EventHook func(Event)
+
+var knownEvents = []struct {
+	pattern *regexp.Regexp
+	kind    EventKind
+	hint    string
+}{
+	{
+		pattern: regexp.MustCompile(`port is already allocated`),
+		kind:    EventPortAllocated,
+		hint:    "another process is already using that host port; stop it or re-run with a different port",
+	},
+	{
+		pattern: regexp.MustCompile(`pull access denied`),
+		kind:    EventPullAccessDenied,
+		hint:    "the image could not be pulled; check that you're logged in to the registry it's hosted on",
+	},
+	{
+		pattern: regexp.MustCompile(`no space left on device`),
+		kind:    EventNoSpace,
+		hint:    "the Docker host is out of disk space; try `docker system prune` and retry",
+	},
+}
+
+// AnnotatingWriter wraps an io.Writer, passing every byte written to it
+// through unchanged while scanning completed lines for known compose
+// warnings and errors. When one matches, a remediation hint is appended
+// to the underlying writer and every registered EventHook is called.
+type AnnotatingWriter struct {
+	w     io.Writer
+	hooks []EventHook
+	buf   bytes.Buffer
+}
+
+// NewAnnotatingWriter returns an AnnotatingWriter writing through to w,
+// notifying hooks whenever a known event is matched.
+func NewAnnotatingWriter(w io.Writer, hooks ...EventHook) *AnnotatingWriter {
+	return &AnnotatingWriter{w: w, hooks: hooks}
+}
+
+// OnEvent registers an additional hook to be called for every Event this
+// writer detects.
+func (a *AnnotatingWriter) OnEvent(hook EventHook) {
+	a.hooks = append(a.hooks, hook)
+}
+
+func (a *AnnotatingWriter) Write(p []byte) (int, error) {
+	n, err := a.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	a.buf.Write(p)
+
+	for {
+		data := a.buf.Bytes()
+		idx := bytes.IndexByte(data, '\n')
+		if idx < 0 {
+			break
+		}
+
+		line := string(data[:idx])
+		a.buf.Next(idx + 1)
+		a.annotate(line)
+	}
+
+	return n, nil
+}
+
+// Close flushes and annotates any trailing partial line left in the
+// buffer, i.e. output written without a final newline before the command
+// exited. Callers that wrap a process's stdout/stderr with an
+// AnnotatingWriter should call Close once the process has finished.
+func (a *AnnotatingWriter) Close() error {
+	if a.buf.Len() == 0 {
+		return nil
+	}
+
+	line := a.buf.String()
+	a.buf.Reset()
+	a.annotate(line)
+
+	return nil
+}
+
+func (a *AnnotatingWriter) annotate(line string) {
+	for _, known := range knownEvents {
+		if !known.pattern.MatchString(line) {
+			continue
+		}
+
+		event := Event{Kind: known.kind, Line: line, Hint: known.hint}
+
+		fmt.Fprintf(a.w, "[sourced] %s\n", event.Hint)
+		for _, hook := range a.hooks {
+			hook(event)
+		}
+
+		return
+	}
+}
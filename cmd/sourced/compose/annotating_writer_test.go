@@ -0,0 +1,111 @@
+package compose
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestAnnotatingWriterPassesBytesThrough(t *testing.T) {
+	var out bytes.Buffer
+	w := NewAnnotatingWriter(&out)
+
+	if _, err := w.Write([]byte("hello\nworld\n")); err != nil {
+		t.Fatalf("Write() unexpected error: %v", err)
+	}
+
+	if got := out.String(); !strings.Contains(got, "hello\nworld\n") {
+		t.Fatalf("Write() = %q, want raw bytes preserved", got)
+	}
+}
+
+func TestAnnotatingWriterAnnotatesKnownEvents(t *testing.T) {
+	cases := []struct {
+		name string
+		line string
+		kind EventKind
+	}{
+		{"port already allocated", "Error starting userland proxy: port is already allocated", EventPortAllocated},
+		{"pull access denied", "pull access denied for myimage, repository does not exist", EventPullAccessDenied},
+		{"no space left", "write /var/lib/docker/foo: no space left on device", EventNoSpace},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var out bytes.Buffer
+			var got []Event
+
+			w := NewAnnotatingWriter(&out, func(e Event) { got = append(got, e) })
+
+			if _, err := w.Write([]byte(c.line + "\n")); err != nil {
+				t.Fatalf("Write() unexpected error: %v", err)
+			}
+
+			if len(got) != 1 {
+				t.Fatalf("expected exactly one event, got %d", len(got))
+			}
+
+			if got[0].Kind != c.kind {
+				t.Fatalf("event kind = %v, want %v", got[0].Kind, c.kind)
+			}
+
+			if got[0].Hint == "" {
+				t.Fatalf("event hint is empty")
+			}
+		})
+	}
+}
+
+func TestAnnotatingWriterIgnoresUnknownLines(t *testing.T) {
+	var out bytes.Buffer
+	var got []Event
+
+	w := NewAnnotatingWriter(&out, func(e Event) { got = append(got, e) })
+
+	if _, err := w.Write([]byte("Creating network foo_default\n")); err != nil {
+		t.Fatalf("Write() unexpected error: %v", err)
+	}
+
+	if len(got) != 0 {
+		t.Fatalf("expected no events, got %d", len(got))
+	}
+}
+
+func TestAnnotatingWriterFlushesTrailingPartialLineOnClose(t *testing.T) {
+	var out bytes.Buffer
+	var got []Event
+
+	w := NewAnnotatingWriter(&out, func(e Event) { got = append(got, e) })
+
+	if _, err := w.Write([]byte("port is already allocated")); err != nil {
+		t.Fatalf("Write() unexpected error: %v", err)
+	}
+
+	if len(got) != 0 {
+		t.Fatalf("expected no events before Close, got %d", len(got))
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() unexpected error: %v", err)
+	}
+
+	if len(got) != 1 {
+		t.Fatalf("expected one event after Close, got %d", len(got))
+	}
+}
+
+func TestAnnotatingWriterOnEvent(t *testing.T) {
+	var out bytes.Buffer
+	w := NewAnnotatingWriter(&out)
+
+	var got []Event
+	w.OnEvent(func(e Event) { got = append(got, e) })
+
+	if _, err := w.Write([]byte("no space left on device\n")); err != nil {
+		t.Fatalf("Write() unexpected error: %v", err)
+	}
+
+	if len(got) != 1 {
+		t.Fatalf("expected one event from hook registered via OnEvent, got %d", len(got))
+	}
+}
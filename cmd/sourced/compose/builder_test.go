@@ -0,0 +1,46 @@
+package compose
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBuildArgv(t *testing.T) {
+	c := &Compose{argv: []string{"docker", "compose"}, extraArgs: []string{"--project-directory", "."}}
+
+	got := c.buildArgv([]string{"up", "-d"})
+	want := []string{"compose", "--compatibility", "--project-directory", ".", "up", "-d"}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("buildArgv() = %v, want %v", got, want)
+	}
+}
+
+func TestBuildEnv(t *testing.T) {
+	c := &Compose{
+		argv:         []string{"docker-compose"},
+		env:          map[string]string{"FOO": "bar"},
+		projectName:  "sourced",
+		composeFiles: []string{"docker-compose.yml", "docker-compose.override.yml"},
+	}
+
+	env := c.buildEnv()
+
+	want := map[string]bool{
+		"FOO=bar":                      false,
+		"COMPOSE_PROJECT_NAME=sourced": false,
+		"COMPOSE_FILE=docker-compose.yml:docker-compose.override.yml": false,
+	}
+
+	for _, e := range env {
+		if _, ok := want[e]; ok {
+			want[e] = true
+		}
+	}
+
+	for e, found := range want {
+		if !found {
+			t.Errorf("buildEnv() missing %q, got %v", e, env)
+		}
+	}
+}
@@ -9,7 +9,10 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/src-d/sourced-ce/cmd/sourced/compose/wait"
 	"github.com/src-d/sourced-ce/cmd/sourced/compose/workdir"
 	"github.com/src-d/sourced-ce/cmd/sourced/dir"
 
@@ -17,6 +20,10 @@ import (
 	goerrors "gopkg.in/src-d/go-errors.v1"
 )
 
+// defaultWaitTimeout is how long Run blocks on registered wait
+// strategies, for each exposed service, before giving up.
+const defaultWaitTimeout = 2 * time.Minute
+
 // dockerComposeVersion is the version of docker-compose to download
 // if docker-compose isn't already present in the system
 const dockerComposeVersion = "1.24.0"
@@ -26,19 +33,232 @@ var composeContainerURL = fmt.Sprintf("https://github.com/docker/compose/release
 // ErrComposeAlternative is returned when docker-compose alternative could not be installed
 var ErrComposeAlternative = goerrors.NewKind("error while trying docker-compose container alternative")
 
+// ComposeEngine identifies which compose implementation a Compose instance
+// was resolved to.
+type ComposeEngine int
+
+const (
+	// ComposeEngineV1 is the standalone docker-compose binary, or the
+	// downloaded container wrapper that emulates it.
+	ComposeEngineV1 ComposeEngine = iota
+	// ComposeEngineV2 is the `docker compose` CLI plugin.
+	ComposeEngineV2
+)
+
 type Compose struct {
-	bin            string
+	// argv is the command prefix used to invoke compose, e.g.
+	// []string{"docker-compose"} or []string{"docker", "compose"}.
+	argv           []string
+	engine         ComposeEngine
 	workdirHandler *workdir.Handler
+
+	env          map[string]string
+	stdin        io.Reader
+	stdout       io.Writer
+	stderr       io.Writer
+	projectName  string
+	composeFiles []string
+	extraArgs    []string
+
+	exposedServices []exposedService
+	waitTimeout     time.Duration
+
+	eventHooks []EventHook
+}
+
+type exposedService struct {
+	service  string
+	port     int
+	strategy wait.Strategy
+}
+
+// WaitError is returned by Run when one or more services registered
+// through WithExposedService did not become ready in time.
+type WaitError struct {
+	// Failures maps service name to the error its strategy returned.
+	Failures map[string]error
+}
+
+func (e *WaitError) Error() string {
+	services := make([]string, 0, len(e.Failures))
+	for service := range e.Failures {
+		services = append(services, service)
+	}
+
+	return fmt.Sprintf("services not ready: %s", strings.Join(services, ", "))
+}
+
+// New resolves the compose binary to use on this system and returns a
+// Compose ready to be configured through its With* builder methods and
+// run.
+func New() (*Compose, error) {
+	workdirHandler, err := workdir.NewHandler()
+	if err != nil {
+		return nil, err
+	}
+
+	argv, engine, err := getOrInstallComposeBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Compose{
+		argv:           argv,
+		engine:         engine,
+		workdirHandler: workdirHandler,
+	}, nil
+}
+
+// composeDriverEnv selects which Driver NewDriver resolves to.
+const composeDriverEnv = "SOURCED_COMPOSE_DRIVER"
+
+// Driver is the surface common to Compose and NativeCompose: running a
+// docker-compose subcommand. It is intentionally narrow — NativeCompose
+// does not yet implement the readiness-waiting or event-hook surface
+// Compose exposes, so callers that need those must use New directly
+// instead of going through NewDriver.
+type Driver interface {
+	Run(ctx context.Context, arg ...string) error
+}
+
+// NewDriver resolves SOURCED_COMPOSE_DRIVER ("native" or "binary",
+// defaulting to "binary") and returns a Driver configured with
+// projectName/composeFiles/env, ready to Run.
+func NewDriver(projectName string, composeFiles []string, env map[string]string) (Driver, error) {
+	if os.Getenv(composeDriverEnv) == "native" {
+		c, err := NewNativeCompose()
+		if err != nil {
+			return nil, err
+		}
+
+		return c.WithProjectName(projectName).WithComposeFiles(composeFiles...).WithEnv(env), nil
+	}
+
+	c, err := New()
+	if err != nil {
+		return nil, err
+	}
+
+	return c.WithProjectName(projectName).WithComposeFiles(composeFiles...).WithEnv(env), nil
+}
+
+// ComposeVersion returns the compose engine that was detected on this
+// system, so that call sites whose behavior differs between v1 and v2
+// (e.g. container naming) can branch accordingly.
+func (c *Compose) ComposeVersion() ComposeEngine {
+	return c.engine
+}
+
+// WithEnv merges the given variables into the environment compose is run
+// with, on top of os.Environ().
+func (c *Compose) WithEnv(env map[string]string) *Compose {
+	c.env = env
+	return c
+}
+
+// WithStdout sets the writer compose's stdout is copied to. Defaults to
+// os.Stdout.
+func (c *Compose) WithStdout(w io.Writer) *Compose {
+	c.stdout = w
+	return c
+}
+
+// WithStderr sets the writer compose's stderr is copied to. Defaults to
+// os.Stderr.
+func (c *Compose) WithStderr(w io.Writer) *Compose {
+	c.stderr = w
+	return c
+}
+
+// WithStdin sets the reader compose's stdin is read from. Defaults to
+// os.Stdin.
+func (c *Compose) WithStdin(r io.Reader) *Compose {
+	c.stdin = r
+	return c
+}
+
+// WithProjectName sets COMPOSE_PROJECT_NAME for the compose invocation.
+func (c *Compose) WithProjectName(name string) *Compose {
+	c.projectName = name
+	return c
+}
+
+// WithComposeFiles sets COMPOSE_FILE, joined with the OS-specific path
+// list separator, for the compose invocation.
+func (c *Compose) WithComposeFiles(files ...string) *Compose {
+	c.composeFiles = files
+	return c
+}
+
+// WithExtraArgs appends arguments right after --compatibility and before
+// the arguments passed to Run/RunWithIO, e.g. global compose flags.
+func (c *Compose) WithExtraArgs(args ...string) *Compose {
+	c.extraArgs = args
+	return c
+}
+
+// WithExposedService registers a readiness strategy for service/port that
+// Run blocks on after `up -d` succeeds, so that callers never observe a
+// service as ready before it actually is.
+func (c *Compose) WithExposedService(service string, port int, strategy wait.Strategy) *Compose {
+	c.exposedServices = append(c.exposedServices, exposedService{
+		service:  service,
+		port:     port,
+		strategy: strategy,
+	})
+	return c
+}
+
+// WithWaitTimeout overrides how long Run waits for each exposed service to
+// become ready before giving up. Defaults to defaultWaitTimeout.
+func (c *Compose) WithWaitTimeout(timeout time.Duration) *Compose {
+	c.waitTimeout = timeout
+	return c
+}
+
+// WithEventHook registers a hook called whenever the output of a run is
+// annotated with a known, actionable event such as a port conflict.
+func (c *Compose) WithEventHook(hook EventHook) *Compose {
+	c.eventHooks = append(c.eventHooks, hook)
+	return c
 }
 
 func (c *Compose) Run(ctx context.Context, arg ...string) error {
-	return c.RunWithIO(ctx, os.Stdin, os.Stdout, os.Stderr, arg...)
+	return c.RunWithIO(ctx, arg...)
+}
+
+// buildArgv assembles the full argument list passed to the compose
+// binary: its own multi-word prefix (e.g. "compose" for the v2 plugin),
+// --compatibility, WithExtraArgs, and finally arg.
+func (c *Compose) buildArgv(arg []string) []string {
+	full := append([]string{"--compatibility"}, append(append([]string{}, c.extraArgs...), arg...)...)
+	return append(append([]string{}, c.argv[1:]...), full...)
+}
+
+// buildEnv assembles the environment the compose command runs with:
+// os.Environ(), WithEnv on top, then COMPOSE_PROJECT_NAME/COMPOSE_FILE if
+// set through WithProjectName/WithComposeFiles.
+func (c *Compose) buildEnv() []string {
+	env := append([]string{}, os.Environ()...)
+
+	for k, v := range c.env {
+		env = append(env, fmt.Sprintf("%s=%s", k, v))
+	}
+
+	if c.projectName != "" {
+		env = append(env, "COMPOSE_PROJECT_NAME="+c.projectName)
+	}
+
+	if len(c.composeFiles) > 0 {
+		env = append(env, "COMPOSE_FILE="+strings.Join(c.composeFiles, string(os.PathListSeparator)))
+	}
+
+	return env
 }
 
-func (c *Compose) RunWithIO(ctx context.Context, stdin io.Reader,
-	stdout, stderr io.Writer, arg ...string) error {
-	arg = append([]string{"--compatibility"}, arg...)
-	cmd := exec.CommandContext(ctx, c.bin, arg...)
+func (c *Compose) RunWithIO(ctx context.Context, arg ...string) error {
+	argv := c.buildArgv(arg)
+	cmd := exec.CommandContext(ctx, c.argv[0], argv...)
 
 	wd, err := c.workdirHandler.Active()
 	if err != nil {
@@ -50,45 +270,138 @@ func (c *Compose) RunWithIO(ctx context.Context, stdin io.Reader,
 	}
 
 	cmd.Dir = wd.Path
-	cmd.Stdin = stdin
-	cmd.Stdout = stdout
-	cmd.Stderr = stderr
+	cmd.Env = c.buildEnv()
+
+	cmd.Stdin = c.stdin
+	if cmd.Stdin == nil {
+		cmd.Stdin = os.Stdin
+	}
 
-	return cmd.Run()
+	stdout := c.stdout
+	if stdout == nil {
+		stdout = os.Stdout
+	}
+
+	stderr := c.stderr
+	if stderr == nil {
+		stderr = os.Stderr
+	}
+
+	stdoutWriter := NewAnnotatingWriter(stdout, c.eventHooks...)
+	stderrWriter := NewAnnotatingWriter(stderr, c.eventHooks...)
+	cmd.Stdout = stdoutWriter
+	cmd.Stderr = stderrWriter
+
+	runErr := cmd.Run()
+	stdoutWriter.Close()
+	stderrWriter.Close()
+
+	if runErr != nil {
+		return runErr
+	}
+
+	if isDetachedUp(argv) && len(c.exposedServices) > 0 {
+		return c.waitForServices(ctx, cmd.Dir)
+	}
+
+	return nil
 }
 
-func newCompose() (*Compose, error) {
-	workdirHandler, err := workdir.NewHandler()
-	if err != nil {
-		return nil, err
+// isDetachedUp reports whether arg is invoking `up` in detached mode,
+// which is the only case where a service can still be warming up once
+// the compose command itself has returned.
+func isDetachedUp(arg []string) bool {
+	var up, detached bool
+	for _, a := range arg {
+		switch a {
+		case "up":
+			up = true
+		case "-d", "--detach":
+			detached = true
+		}
 	}
 
-	bin, err := getOrInstallComposeBinary()
-	if err != nil {
-		return nil, err
+	return up && detached
+}
+
+// waitForServices blocks until every registered exposed service reports
+// ready, or the wait timeout elapses.
+func (c *Compose) waitForServices(ctx context.Context, workdirPath string) error {
+	timeout := c.waitTimeout
+	if timeout == 0 {
+		timeout = defaultWaitTimeout
 	}
 
-	return &Compose{
-		bin:            bin,
-		workdirHandler: workdirHandler,
-	}, nil
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	target := wait.Target{
+		Argv: c.argv,
+		Dir:  workdirPath,
+	}
+
+	var (
+		mu       sync.Mutex
+		failures = map[string]error{}
+		wg       sync.WaitGroup
+	)
+
+	for _, es := range c.exposedServices {
+		wg.Add(1)
+		go func(es exposedService) {
+			defer wg.Done()
+
+			t := target
+			t.Service = es.service
+			t.Port = es.port
+
+			if err := es.strategy.WaitUntilReady(ctx, t); err != nil {
+				mu.Lock()
+				failures[es.service] = err
+				mu.Unlock()
+			}
+		}(es)
+	}
+
+	wg.Wait()
+
+	if len(failures) > 0 {
+		return &WaitError{Failures: failures}
+	}
+
+	return nil
 }
 
-func getOrInstallComposeBinary() (string, error) {
+// getOrInstallComposeBinary resolves the compose command prefix to invoke,
+// preferring the `docker compose` CLI plugin (v2), then falling back to the
+// standalone docker-compose binary (v1), and finally to a downloaded
+// container wrapper that emulates the v1 binary.
+func getOrInstallComposeBinary() ([]string, ComposeEngine, error) {
+	if isDockerComposePluginAvailable() {
+		return []string{"docker", "compose"}, ComposeEngineV2, nil
+	}
+
 	path, err := exec.LookPath("docker-compose")
 	if err == nil {
 		bin := strings.TrimSpace(path)
 		if bin != "" {
-			return bin, nil
+			return []string{bin}, ComposeEngineV1, nil
 		}
 	}
 
 	path, err = getOrInstallComposeContainer()
 	if err != nil {
-		return "", ErrComposeAlternative.Wrap(err)
+		return nil, ComposeEngineV1, ErrComposeAlternative.Wrap(err)
 	}
 
-	return path, nil
+	return []string{path}, ComposeEngineV1, nil
+}
+
+// isDockerComposePluginAvailable reports whether the `docker compose` CLI
+// plugin is installed and usable.
+func isDockerComposePluginAvailable() bool {
+	cmd := exec.Command("docker", "compose", "version")
+	return cmd.Run() == nil
 }
 
 func getOrInstallComposeContainer() (altPath string, err error) {
@@ -131,21 +444,3 @@ func downloadCompose(path string) error {
 
 	return dir.DownloadURL(composeContainerURL, path)
 }
-
-func Run(ctx context.Context, arg ...string) error {
-	comp, err := newCompose()
-	if err != nil {
-		return err
-	}
-
-	return comp.Run(ctx, arg...)
-}
-
-func RunWithIO(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer, arg ...string) error {
-	comp, err := newCompose()
-	if err != nil {
-		return err
-	}
-
-	return comp.RunWithIO(ctx, stdin, stdout, stderr, arg...)
-}
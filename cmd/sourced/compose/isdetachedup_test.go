@@ -0,0 +1,27 @@
+package compose
+
+import "testing"
+
+func TestIsDetachedUp(t *testing.T) {
+	cases := []struct {
+		name string
+		arg  []string
+		want bool
+	}{
+		{"up detached short flag", []string{"up", "-d"}, true},
+		{"up detached long flag", []string{"up", "--detach"}, true},
+		{"up detached with extra args", []string{"--compatibility", "up", "-d", "gitbase"}, true},
+		{"up without detach", []string{"up"}, false},
+		{"detach flag without up", []string{"-d"}, false},
+		{"down", []string{"down"}, false},
+		{"empty", nil, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := isDetachedUp(c.arg); got != c.want {
+				t.Fatalf("isDetachedUp(%v) = %v, want %v", c.arg, got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,491 @@
+package compose
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/src-d/sourced-ce/cmd/sourced/compose/workdir"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/nat"
+	"gopkg.in/yaml.v3"
+)
+
+// Resources created by NativeCompose carry the same labels docker-compose
+// itself sets, so that the docker-compose CLI still recognizes them if a
+// user mixes the native driver with the binary one.
+const (
+	composeLabelProject = "com.docker.compose.project"
+	composeLabelService = "com.docker.compose.service"
+)
+
+// composeFile is the subset of the compose YAML schema NativeCompose
+// understands.
+type composeFile struct {
+	Services map[string]composeService    `yaml:"services"`
+	Networks map[string]map[string]string `yaml:"networks"`
+	Volumes  map[string]map[string]string `yaml:"volumes"`
+}
+
+type composeService struct {
+	Image       string              `yaml:"image"`
+	Environment map[string]string   `yaml:"environment"`
+	Ports       []string            `yaml:"ports"`
+	Volumes     []string            `yaml:"volumes"`
+	Networks    []string            `yaml:"networks"`
+	DependsOn   []string            `yaml:"depends_on"`
+	Healthcheck *composeHealthcheck `yaml:"healthcheck"`
+}
+
+type composeHealthcheck struct {
+	Test     []string `yaml:"test"`
+	Interval string   `yaml:"interval"`
+	Timeout  string   `yaml:"timeout"`
+	Retries  int      `yaml:"retries"`
+}
+
+// NativeCompose talks to the Docker Engine API directly instead of
+// shelling out to docker-compose, so that sourced-ce doesn't depend on a
+// docker-compose binary, or the docker compose plugin, being installed.
+// It implements Driver, so it can be selected via NewDriver and
+// SOURCED_COMPOSE_DRIVER=native, but it does not yet support the
+// readiness-waiting or error-annotation surface Compose exposes — callers
+// that need those must use New/NewDriver's binary path instead.
+type NativeCompose struct {
+	cli            *client.Client
+	workdirHandler *workdir.Handler
+
+	projectName  string
+	composeFiles []string
+	env          map[string]string
+}
+
+// NewNativeCompose connects to the local Docker Engine and returns a
+// NativeCompose ready to be configured through its With* methods and run.
+func NewNativeCompose() (*NativeCompose, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, err
+	}
+
+	workdirHandler, err := workdir.NewHandler()
+	if err != nil {
+		return nil, err
+	}
+
+	return &NativeCompose{
+		cli:            cli,
+		workdirHandler: workdirHandler,
+	}, nil
+}
+
+// WithProjectName sets the compose project name resources are labeled and
+// named with.
+func (c *NativeCompose) WithProjectName(name string) *NativeCompose {
+	c.projectName = name
+	return c
+}
+
+// WithComposeFiles sets the compose YAML files the project is parsed
+// from, applied in order.
+func (c *NativeCompose) WithComposeFiles(files ...string) *NativeCompose {
+	c.composeFiles = files
+	return c
+}
+
+// WithEnv merges the given variables into every service's container
+// environment, on top of whatever the compose file itself declares.
+func (c *NativeCompose) WithEnv(env map[string]string) *NativeCompose {
+	c.env = env
+	return c
+}
+
+// Run interprets arg as a docker-compose subcommand. Only "up" and "down"
+// are implemented natively; anything else is rejected, since replicating
+// the full docker-compose CLI surface is out of scope.
+func (c *NativeCompose) Run(ctx context.Context, arg ...string) error {
+	if len(arg) == 0 {
+		return fmt.Errorf("native compose driver: no subcommand given")
+	}
+
+	switch arg[0] {
+	case "up":
+		return c.up(ctx)
+	case "down":
+		return c.down(ctx)
+	default:
+		return fmt.Errorf("native compose driver: unsupported subcommand %q", arg[0])
+	}
+}
+
+func (c *NativeCompose) loadProject() (*composeFile, error) {
+	project := &composeFile{
+		Services: map[string]composeService{},
+		Networks: map[string]map[string]string{},
+		Volumes:  map[string]map[string]string{},
+	}
+
+	for _, path := range c.composeFiles {
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		var f composeFile
+		if err := yaml.Unmarshal(raw, &f); err != nil {
+			return nil, err
+		}
+
+		for name, svc := range f.Services {
+			project.Services[name] = svc
+		}
+		for name, cfg := range f.Networks {
+			project.Networks[name] = cfg
+		}
+		for name, cfg := range f.Volumes {
+			project.Volumes[name] = cfg
+		}
+	}
+
+	return project, nil
+}
+
+// up creates the project's network and containers, starting services in
+// the order their depends_on graph demands.
+func (c *NativeCompose) up(ctx context.Context) error {
+	project, err := c.loadProject()
+	if err != nil {
+		return err
+	}
+
+	netName := c.projectName + "_default"
+	if err := c.ensureNetwork(ctx, netName); err != nil {
+		return err
+	}
+
+	for name := range project.Networks {
+		if err := c.ensureNetwork(ctx, c.projectName+"_"+name); err != nil {
+			return err
+		}
+	}
+
+	for name := range project.Volumes {
+		if err := c.ensureVolume(ctx, c.projectName+"_"+name); err != nil {
+			return err
+		}
+	}
+
+	order, err := topoSortServices(project.Services)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range order {
+		if err := c.startService(ctx, netName, name, project.Services[name], project.Volumes); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ensureNetwork creates name if a network with that name doesn't already
+// exist, so that re-running up against the same project reuses it instead
+// of failing.
+func (c *NativeCompose) ensureNetwork(ctx context.Context, name string) error {
+	_, err := c.cli.NetworkInspect(ctx, name, types.NetworkInspectOptions{})
+	if err == nil {
+		return nil
+	}
+	if !client.IsErrNotFound(err) {
+		return err
+	}
+
+	_, err = c.cli.NetworkCreate(ctx, name, types.NetworkCreate{
+		Labels: map[string]string{composeLabelProject: c.projectName},
+	})
+
+	return err
+}
+
+// ensureVolume creates name if a volume with that name doesn't already
+// exist, so that re-running up against the same project reuses it instead
+// of failing.
+func (c *NativeCompose) ensureVolume(ctx context.Context, name string) error {
+	_, err := c.cli.VolumeInspect(ctx, name)
+	if err == nil {
+		return nil
+	}
+	if !client.IsErrNotFound(err) {
+		return err
+	}
+
+	_, err = c.cli.VolumeCreate(ctx, volume.VolumeCreateBody{
+		Name:   name,
+		Labels: map[string]string{composeLabelProject: c.projectName},
+	})
+
+	return err
+}
+
+func (c *NativeCompose) startService(ctx context.Context, defaultNetwork, name string, svc composeService, namedVolumes map[string]map[string]string) error {
+	containerName := fmt.Sprintf("%s_%s_1", c.projectName, name)
+
+	if existing, _, err := c.cli.ContainerInspectWithRaw(ctx, containerName, false); err == nil {
+		if existing.State != nil && existing.State.Running {
+			return nil
+		}
+
+		return c.cli.ContainerStart(ctx, existing.ID, types.ContainerStartOptions{})
+	} else if !client.IsErrNotFound(err) {
+		return err
+	}
+
+	reader, err := c.cli.ImagePull(ctx, svc.Image, types.ImagePullOptions{})
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	io.Copy(ioutil.Discard, reader)
+
+	merged := make(map[string]string, len(svc.Environment)+len(c.env))
+	for k, v := range svc.Environment {
+		merged[k] = v
+	}
+	for k, v := range c.env {
+		merged[k] = v
+	}
+
+	env := make([]string, 0, len(merged))
+	for k, v := range merged {
+		env = append(env, fmt.Sprintf("%s=%s", k, v))
+	}
+
+	exposedPorts, portBindings, err := parsePorts(svc.Ports)
+	if err != nil {
+		return err
+	}
+
+	config := &container.Config{
+		Image:        svc.Image,
+		Env:          env,
+		ExposedPorts: exposedPorts,
+		Labels: map[string]string{
+			composeLabelProject: c.projectName,
+			composeLabelService: name,
+		},
+	}
+
+	if hc, err := toHealthConfig(svc.Healthcheck); err != nil {
+		return err
+	} else if hc != nil {
+		config.Healthcheck = hc
+	}
+
+	hostConfig := &container.HostConfig{
+		PortBindings: portBindings,
+		Binds:        c.translateVolumes(svc.Volumes, namedVolumes),
+	}
+
+	var networkingConfig *network.NetworkingConfig
+	var extraNetworks []string
+	if len(svc.Networks) == 0 {
+		hostConfig.NetworkMode = container.NetworkMode(defaultNetwork)
+	} else {
+		// The Engine API rejects more than one entry in EndpointsConfig at
+		// create time, so only the first network is attached here; the
+		// rest are joined afterward with NetworkConnect.
+		first := c.projectName + "_" + svc.Networks[0]
+		networkingConfig = &network.NetworkingConfig{
+			EndpointsConfig: map[string]*network.EndpointSettings{first: {}},
+		}
+		for _, netName := range svc.Networks[1:] {
+			extraNetworks = append(extraNetworks, c.projectName+"_"+netName)
+		}
+	}
+
+	created, err := c.cli.ContainerCreate(ctx, config, hostConfig, networkingConfig, nil, containerName)
+	if err != nil {
+		return err
+	}
+
+	for _, netName := range extraNetworks {
+		if err := c.cli.NetworkConnect(ctx, netName, created.ID, &network.EndpointSettings{}); err != nil {
+			return err
+		}
+	}
+
+	return c.cli.ContainerStart(ctx, created.ID, types.ContainerStartOptions{})
+}
+
+// parsePorts translates compose short-syntax port mappings
+// ("8080:80", "8080:80/udp", "80") into the Engine API's port types.
+func parsePorts(specs []string) (nat.PortSet, nat.PortMap, error) {
+	exposed := nat.PortSet{}
+	bindings := nat.PortMap{}
+
+	for _, spec := range specs {
+		parts := strings.Split(spec, ":")
+
+		var hostPort, containerPort string
+		switch len(parts) {
+		case 1:
+			containerPort = parts[0]
+		case 2:
+			hostPort, containerPort = parts[0], parts[1]
+		case 3:
+			hostPort, containerPort = parts[1], parts[2]
+		default:
+			return nil, nil, fmt.Errorf("invalid port mapping %q", spec)
+		}
+
+		proto := "tcp"
+		if i := strings.Index(containerPort, "/"); i >= 0 {
+			proto = containerPort[i+1:]
+			containerPort = containerPort[:i]
+		}
+
+		port, err := nat.NewPort(proto, containerPort)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		exposed[port] = struct{}{}
+		if hostPort != "" {
+			bindings[port] = append(bindings[port], nat.PortBinding{HostPort: hostPort})
+		}
+	}
+
+	return exposed, bindings, nil
+}
+
+// translateVolumes rewrites compose volume mounts into Engine API bind
+// mounts, resolving references to top-level named volumes to the
+// project-prefixed name they were created under.
+func (c *NativeCompose) translateVolumes(volumes []string, namedVolumes map[string]map[string]string) []string {
+	binds := make([]string, 0, len(volumes))
+
+	for _, v := range volumes {
+		parts := strings.SplitN(v, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		source := parts[0]
+		if _, ok := namedVolumes[source]; ok {
+			source = c.projectName + "_" + source
+		}
+
+		binds = append(binds, source+":"+parts[1])
+	}
+
+	return binds
+}
+
+// toHealthConfig translates a compose healthcheck into the Engine API's
+// equivalent, returning nil if none is set.
+func toHealthConfig(hc *composeHealthcheck) (*container.HealthConfig, error) {
+	if hc == nil {
+		return nil, nil
+	}
+
+	config := &container.HealthConfig{
+		Test:    hc.Test,
+		Retries: hc.Retries,
+	}
+
+	if hc.Interval != "" {
+		interval, err := time.ParseDuration(hc.Interval)
+		if err != nil {
+			return nil, err
+		}
+		config.Interval = interval
+	}
+
+	if hc.Timeout != "" {
+		timeout, err := time.ParseDuration(hc.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		config.Timeout = timeout
+	}
+
+	return config, nil
+}
+
+// down stops and removes every container labeled with this project.
+func (c *NativeCompose) down(ctx context.Context) error {
+	containers, err := c.cli.ContainerList(ctx, types.ContainerListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", composeLabelProject+"="+c.projectName)),
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, cont := range containers {
+		if err := c.cli.ContainerRemove(ctx, cont.ID, types.ContainerRemoveOptions{Force: true}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// topoSortServices orders services so that every service appears after
+// everything it depends_on.
+func topoSortServices(services map[string]composeService) ([]string, error) {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+
+	state := map[string]int{}
+	var order []string
+
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case done:
+			return nil
+		case visiting:
+			return fmt.Errorf("circular depends_on involving service %q", name)
+		}
+
+		state[name] = visiting
+		for _, dep := range services[name].DependsOn {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		state[name] = done
+		order = append(order, name)
+
+		return nil
+	}
+
+	names := make([]string, 0, len(services))
+	for name := range services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := visit(name); err != nil {
+			return nil, err
+		}
+	}
+
+	return order, nil
+}
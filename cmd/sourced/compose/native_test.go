@@ -0,0 +1,162 @@
+package compose
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTopoSortServices(t *testing.T) {
+	cases := []struct {
+		name     string
+		services map[string]composeService
+		want     []string
+		wantErr  bool
+	}{
+		{
+			name: "linear chain",
+			services: map[string]composeService{
+				"web": {DependsOn: []string{"api"}},
+				"api": {DependsOn: []string{"db"}},
+				"db":  {},
+			},
+			want: []string{"db", "api", "web"},
+		},
+		{
+			name: "no dependencies sorted by name",
+			services: map[string]composeService{
+				"b": {},
+				"a": {},
+			},
+			want: []string{"a", "b"},
+		},
+		{
+			name: "diamond dependency",
+			services: map[string]composeService{
+				"app":   {DependsOn: []string{"cache", "db"}},
+				"cache": {DependsOn: []string{"db"}},
+				"db":    {},
+			},
+			want: []string{"db", "cache", "app"},
+		},
+		{
+			name: "circular dependency",
+			services: map[string]composeService{
+				"a": {DependsOn: []string{"b"}},
+				"b": {DependsOn: []string{"a"}},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := topoSortServices(c.services)
+
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("topoSortServices() expected an error, got none")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("topoSortServices() unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("topoSortServices() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestParsePorts(t *testing.T) {
+	exposed, bindings, err := parsePorts([]string{"80", "8081:81", "127.0.0.1:9090:90/udp"})
+	if err != nil {
+		t.Fatalf("parsePorts() unexpected error: %v", err)
+	}
+
+	if len(exposed) != 3 {
+		t.Fatalf("parsePorts() exposed %d ports, want 3", len(exposed))
+	}
+
+	if len(bindings) != 2 {
+		t.Fatalf("parsePorts() bound %d ports, want 2", len(bindings))
+	}
+}
+
+func TestLoadProject(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "docker-compose.yml")
+
+	yaml := `
+services:
+  web:
+    image: nginx
+networks:
+  front:
+    driver: bridge
+volumes:
+  data:
+    driver: local
+`
+	if err := os.WriteFile(path, []byte(yaml), 0600); err != nil {
+		t.Fatalf("WriteFile() unexpected error: %v", err)
+	}
+
+	c := &NativeCompose{composeFiles: []string{path}}
+
+	project, err := c.loadProject()
+	if err != nil {
+		t.Fatalf("loadProject() unexpected error: %v", err)
+	}
+
+	if _, ok := project.Services["web"]; !ok {
+		t.Fatalf("loadProject() services = %v, want %q present", project.Services, "web")
+	}
+
+	if _, ok := project.Networks["front"]; !ok {
+		t.Fatalf("loadProject() networks = %v, want %q present", project.Networks, "front")
+	}
+
+	if _, ok := project.Volumes["data"]; !ok {
+		t.Fatalf("loadProject() volumes = %v, want %q present", project.Volumes, "data")
+	}
+}
+
+func TestTranslateVolumes(t *testing.T) {
+	c := &NativeCompose{projectName: "myproj"}
+	named := map[string]map[string]string{"data": nil}
+
+	got := c.translateVolumes([]string{"data:/var/lib/data", "/host/path:/container/path", "bind-mount-only"}, named)
+	want := []string{"myproj_data:/var/lib/data", "/host/path:/container/path"}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("translateVolumes() = %v, want %v", got, want)
+	}
+}
+
+func TestToHealthConfig(t *testing.T) {
+	if got, err := toHealthConfig(nil); err != nil || got != nil {
+		t.Fatalf("toHealthConfig(nil) = %v, %v, want nil, nil", got, err)
+	}
+
+	hc := &composeHealthcheck{
+		Test:     []string{"CMD", "curl", "-f", "http://localhost"},
+		Interval: "10s",
+		Timeout:  "2s",
+		Retries:  3,
+	}
+
+	got, err := toHealthConfig(hc)
+	if err != nil {
+		t.Fatalf("toHealthConfig() unexpected error: %v", err)
+	}
+
+	if got.Interval != 10*time.Second || got.Timeout != 2*time.Second || got.Retries != 3 {
+		t.Fatalf("toHealthConfig() = %+v, want Interval=10s Timeout=2s Retries=3", got)
+	}
+}
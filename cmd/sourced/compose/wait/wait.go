@@ -0,0 +1,190 @@
+// Package wait implements readiness strategies that a compose.Compose can
+// block on after bringing services up, so that callers don't have to poll
+// or sleep-and-hope for a container to finish warming up.
+package wait
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Target describes how a Strategy reaches the service it is waiting on.
+type Target struct {
+	// Argv is the compose command prefix, e.g. []string{"docker-compose"}
+	// or []string{"docker", "compose"}.
+	Argv []string
+	// Dir is the working directory of the compose project.
+	Dir string
+	// Service is the compose service name being waited on.
+	Service string
+	// Port is the container port registered for this service through
+	// Compose.WithExposedService.
+	Port int
+}
+
+// Strategy waits until a service is considered ready, returning an error
+// describing why it never became so.
+type Strategy interface {
+	WaitUntilReady(ctx context.Context, target Target) error
+}
+
+// ForLog returns a Strategy that tails the service's logs and waits until
+// pattern has matched at least occurrences lines.
+func ForLog(pattern string, occurrences int) Strategy {
+	return &logStrategy{pattern: regexp.MustCompile(pattern), occurrences: occurrences}
+}
+
+type logStrategy struct {
+	pattern     *regexp.Regexp
+	occurrences int
+}
+
+func (s *logStrategy) WaitUntilReady(ctx context.Context, target Target) error {
+	arg := append(append([]string{}, target.Argv[1:]...), "logs", "-f", target.Service)
+	cmd := exec.CommandContext(ctx, target.Argv[0], arg...)
+	cmd.Dir = target.Dir
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	matches := 0
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		if s.pattern.MatchString(scanner.Text()) {
+			matches++
+			if matches >= s.occurrences {
+				return nil
+			}
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return fmt.Errorf("log never matched %q %d time(s) for service %q", s.pattern.String(), s.occurrences, target.Service)
+}
+
+// ForListeningPort returns a Strategy that execs into the service's
+// container and dials port in a loop until it accepts connections.
+func ForListeningPort(port int) Strategy {
+	return &portStrategy{port: port}
+}
+
+type portStrategy struct {
+	port int
+}
+
+// portCheckScript probes a TCP port with whatever POSIX sh has on hand,
+// rather than relying on /dev/tcp, which is a bash extension many
+// production images (dash, busybox ash) don't support: nc if present,
+// otherwise a tiny Python fallback.
+const portCheckScript = `
+if command -v nc >/dev/null 2>&1; then
+	exec nc -z 127.0.0.1 "$1"
+fi
+exec python3 -c "import socket,sys; s=socket.create_connection(('127.0.0.1', int(sys.argv[1])), 2)" "$1"
+`
+
+func (s *portStrategy) WaitUntilReady(ctx context.Context, target Target) error {
+	for {
+		arg := append(append([]string{}, target.Argv[1:]...),
+			"exec", "-T", target.Service, "sh", "-c", portCheckScript, "--", strconv.Itoa(s.port))
+		cmd := exec.CommandContext(ctx, target.Argv[0], arg...)
+		cmd.Dir = target.Dir
+
+		if err := cmd.Run(); err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("port %d never opened for service %q", s.port, target.Service)
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// ForHTTP returns a Strategy that discovers the service's host port
+// mapping with `docker-compose port` and polls path until it responds
+// with statusCode.
+func ForHTTP(path string, statusCode int) Strategy {
+	return &httpStrategy{path: path, statusCode: statusCode}
+}
+
+type httpStrategy struct {
+	path       string
+	statusCode int
+}
+
+// httpCheckTimeout bounds a single poll attempt, so a connection that's
+// accepted but never responds can't hang past the caller's own timeout.
+const httpCheckTimeout = 5 * time.Second
+
+func (s *httpStrategy) WaitUntilReady(ctx context.Context, target Target) error {
+	client := &http.Client{Timeout: httpCheckTimeout}
+
+	for {
+		if addr, err := mappedPort(ctx, target); err == nil {
+			if ready, err := s.check(ctx, client, addr); err == nil && ready {
+				return nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s never returned status %d for service %q", s.path, s.statusCode, target.Service)
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (s *httpStrategy) check(ctx context.Context, client *http.Client, addr string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://%s%s", addr, s.path), nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	return resp.StatusCode == s.statusCode, nil
+}
+
+func mappedPort(ctx context.Context, target Target) (string, error) {
+	arg := append(append([]string{}, target.Argv[1:]...), "port", target.Service, strconv.Itoa(target.Port))
+	cmd := exec.CommandContext(ctx, target.Argv[0], arg...)
+	cmd.Dir = target.Dir
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+
+	addr := strings.TrimSpace(string(out))
+	if addr == "" {
+		return "", fmt.Errorf("no port mapping published for service %q port %d", target.Service, target.Port)
+	}
+
+	return addr, nil
+}